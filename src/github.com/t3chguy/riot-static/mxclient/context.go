@@ -0,0 +1,122 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"errors"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/t3chguy/riot-static/utils"
+)
+
+// ContextResponse mirrors the shape of a homeserver's /context/{eventId} response: a window of
+// timeline events either side of the requested event, plus the room state as it stood at that
+// point in the timeline.
+type ContextResponse struct {
+	Event        gomatrix.Event
+	EventsBefore []gomatrix.Event
+	EventsAfter  []gomatrix.Event
+	State        []gomatrix.Event
+}
+
+// GetEventContext returns up to `before` events preceding eventID, up to `after` events following
+// it, and the room state at that point in the timeline, so the viewer can permalink to a single
+// event with its surrounding conversation. When lazyLoadMembers is true, the m.room.member events
+// in State are restricted to senders who actually appear in Event/EventsBefore/EventsAfter, while
+// state events of every other type are kept, mirroring the lazy-loading filter dendrite applies to
+// /context and /messages.
+func (r *Room) GetEventContext(eventID string, before, after int, lazyLoadMembers bool) (ContextResponse, error) {
+	anchorPos, found := r.findEventIndex(eventID, true)
+	if !found {
+		return ContextResponse{}, errors.New("Could not find event")
+	}
+
+	// topologicalOrdering runs oldest (position 0) to newest, so "before" (older) events sit at
+	// lower positions and "after" (newer) events sit at higher positions.
+	length := len(r.topologicalOrdering)
+	eventsBefore := r.eventsInRange(utils.Max(anchorPos-before, 0), anchorPos)
+	eventsAfter := r.eventsInRange(anchorPos+1, utils.Min(anchorPos+1+after, length))
+
+	target := r.eventList[r.topologicalOrdering[anchorPos]].Event
+	state := r.stateEventsAtIndex(anchorPos)
+	if lazyLoadMembers {
+		state = filterLazyLoadedMembers(state, target, eventsBefore, eventsAfter)
+	}
+
+	return ContextResponse{
+		Event:        target,
+		EventsBefore: eventsBefore,
+		EventsAfter:  eventsAfter,
+		State:        state,
+	}, nil
+}
+
+// stateEventsAtIndex reconstructs the room state as of anchorPos by seeding from r.initialState -
+// the state snapshot as of the oldest event eventList covers, fixed at NewRoom time - and then
+// folding in state events from [0, anchorPos] in timeline order, so a later state change in that
+// range overrides the seed. r.latestRoomState is NOT used here: it keeps advancing as the room
+// syncs forward, so it reflects "state right now" rather than "state as of the window's start",
+// and seeding from it would leak any state change that happens after anchorPos but is still within
+// the held window back into the reconstruction of a point in the past.
+func (r *Room) stateEventsAtIndex(anchorPos int) []gomatrix.Event {
+	type stateEventKey struct {
+		eventType string
+		stateKey  string
+	}
+
+	latest := make(map[stateEventKey]gomatrix.Event)
+	for _, event := range r.initialState {
+		if event.StateKey == nil {
+			continue
+		}
+		latest[stateEventKey{event.Type, *event.StateKey}] = event
+	}
+
+	for _, event := range r.eventsInRange(0, anchorPos+1) {
+		if event.StateKey == nil {
+			continue
+		}
+		latest[stateEventKey{event.Type, *event.StateKey}] = event
+	}
+
+	state := make([]gomatrix.Event, 0, len(latest))
+	for _, event := range latest {
+		state = append(state, event)
+	}
+	return state
+}
+
+// filterLazyLoadedMembers drops m.room.member state events whose target user - the user the
+// membership event is about, i.e. its state_key, not whoever performed the membership change -
+// doesn't appear as a sender in the returned timeline window, leaving all other state event types
+// untouched.
+func filterLazyLoadedMembers(state []gomatrix.Event, target gomatrix.Event, before, after []gomatrix.Event) []gomatrix.Event {
+	relevantSenders := map[string]bool{target.Sender: true}
+	for _, event := range before {
+		relevantSenders[event.Sender] = true
+	}
+	for _, event := range after {
+		relevantSenders[event.Sender] = true
+	}
+
+	filtered := make([]gomatrix.Event, 0, len(state))
+	for _, event := range state {
+		if event.Type == "m.room.member" && (event.StateKey == nil || !relevantSenders[*event.StateKey]) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// TestStateEventsAtIndexDoesNotLeakFutureState pins the bug a live-state seed would reintroduce:
+// a state event that changes somewhere after the anchor, but still within the held window, must
+// not be visible in the state reconstructed *at* the anchor.
+func TestStateEventsAtIndexDoesNotLeakFutureState(t *testing.T) {
+	stateKey := ""
+	oldTopic := gomatrix.Event{Type: "m.room.topic", StateKey: &stateKey, Content: map[string]interface{}{"topic": "old"}}
+	newTopic := gomatrix.Event{ID: "$newtopic:example.com", Type: "m.room.topic", StateKey: &stateKey, Content: map[string]interface{}{"topic": "new"}}
+	anchorMsg := gomatrix.Event{ID: "$anchor:example.com", Type: "m.room.message"}
+
+	r := &Room{
+		roomVersion:  DefaultRoomVersion,
+		eventIndex:   make(map[string]int),
+		initialState: []gomatrix.Event{oldTopic},
+	}
+	r.appendNewerEvents(r.headerAll([]gomatrix.Event{anchorMsg, newTopic}))
+
+	anchorPos, ok := r.eventIndex[anchorMsg.ID]
+	if !ok {
+		t.Fatalf("anchor event missing from eventIndex")
+	}
+
+	state := r.stateEventsAtIndex(anchorPos)
+	topic := findStateEvent(state, "m.room.topic", "")
+	if topic == nil {
+		t.Fatalf("expected m.room.topic in reconstructed state")
+	}
+	if topic.Content["topic"] != "old" {
+		t.Errorf("state at anchor leaked a future change: got topic %v, want \"old\"", topic.Content["topic"])
+	}
+
+	// Sanity check the other end: asking for state at the newer position should see the change.
+	newerPos := r.eventIndex[newTopic.ID]
+	state = r.stateEventsAtIndex(newerPos)
+	topic = findStateEvent(state, "m.room.topic", "")
+	if topic == nil || topic.Content["topic"] != "new" {
+		t.Errorf("state at the topic change itself should show the new topic, got %v", topic)
+	}
+}
+
+func findStateEvent(state []gomatrix.Event, eventType, stateKey string) *gomatrix.Event {
+	for i, event := range state {
+		if event.Type == eventType && event.StateKey != nil && *event.StateKey == stateKey {
+			return &state[i]
+		}
+	}
+	return nil
+}
+
+// TestFilterLazyLoadedMembersKeepsTargetNotSender pins the other context.go bug: an m.room.member
+// event's relevant user is its state_key (who the membership is about), not its sender (who
+// performed the change) - an invite/kick/ban routinely has sender != state_key.
+func TestFilterLazyLoadedMembersKeepsTargetNotSender(t *testing.T) {
+	targetUser := "@target:example.com"
+	adminUser := "@admin:example.com"
+
+	memberEvent := gomatrix.Event{
+		Type:     "m.room.member",
+		Sender:   adminUser,
+		StateKey: &targetUser,
+		Content:  map[string]interface{}{"membership": "invite"},
+	}
+	anchor := gomatrix.Event{ID: "$anchor:example.com", Sender: targetUser}
+
+	filtered := filterLazyLoadedMembers([]gomatrix.Event{memberEvent}, anchor, nil, nil)
+	if len(filtered) != 1 {
+		t.Fatalf("expected the invited target's member event to survive, got %v", filtered)
+	}
+
+	// An unrelated admin who neither sent nor is the subject of any timeline event in the window
+	// should be filtered out.
+	unrelatedAdmin := "@unrelated-admin:example.com"
+	unrelatedMember := gomatrix.Event{
+		Type:     "m.room.member",
+		Sender:   unrelatedAdmin,
+		StateKey: &unrelatedAdmin,
+		Content:  map[string]interface{}{"membership": "join"},
+	}
+	filtered = filterLazyLoadedMembers([]gomatrix.Event{memberEvent, unrelatedMember}, anchor, nil, nil)
+	if len(filtered) != 1 || filtered[0].Sender != adminUser {
+		t.Errorf("expected only the target's member event to survive, got %v", filtered)
+	}
+}
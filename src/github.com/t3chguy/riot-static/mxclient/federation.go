@@ -0,0 +1,264 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// federationBackfillResponse is the body of a /_matrix/federation/v1/backfill response.
+type federationBackfillResponse struct {
+	Origin         string            `json:"origin"`
+	OriginServerTS int64             `json:"origin_server_ts"`
+	PDUs           []json.RawMessage `json:"pdus"`
+}
+
+// FederationBackfiller fills in timeline gaps by talking directly to the servers already
+// participating in a room, for the case where the account's own homeserver has limited history
+// for that room. This mirrors the roomserver backfill design: ask the servers that were already
+// in the room, verify what comes back, and walk auth_events to pull in anything missing.
+type FederationBackfiller struct {
+	serverName string
+	keyID      gomatrixserverlib.KeyID
+	signingKey gomatrixserverlib.PrivateKey
+	verifier   gomatrixserverlib.JSONVerifier
+	httpClient *http.Client
+}
+
+// NewFederationBackfiller constructs a FederationBackfiller that signs outgoing requests as
+// serverName using signingKey/keyID, and checks responses with verifier.
+func NewFederationBackfiller(serverName string, keyID gomatrixserverlib.KeyID, signingKey gomatrixserverlib.PrivateKey, verifier gomatrixserverlib.JSONVerifier) *FederationBackfiller {
+	return &FederationBackfiller{
+		serverName: serverName,
+		keyID:      keyID,
+		signingKey: signingKey,
+		verifier:   verifier,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// Backfill fetches up to limit events older than the earliest event currently held for r from
+// the servers known to have participated in the room (r.latestRoomState.Servers()), verifies
+// their signatures, resolves any auth events we don't already have, and merges the result into
+// r's timeline as older history. It returns the number of new events merged in.
+func (fb *FederationBackfiller) Backfill(r *Room, limit int) (int, error) {
+	servers := r.latestRoomState.Servers()
+	if len(servers) == 0 {
+		return 0, fmt.Errorf("federation backfill: room %s has no known servers", r.ID)
+	}
+
+	// Position 0 of topologicalOrdering is always the oldest event we hold.
+	earliestEventID := r.eventList[r.topologicalOrdering[0]].Event.ID
+
+	var lastErr error
+	for _, server := range servers {
+		events, err := fb.backfillFromServer(server, r.ID, earliestEventID, limit)
+		if err != nil {
+			lastErr = err
+			log.Printf("federation backfill: %s failed for room %s: %v", server, r.ID, err)
+			continue
+		}
+
+		newEvents, err := fb.resolveAuthChain(server, r, events)
+		if err != nil {
+			lastErr = err
+			log.Printf("federation backfill: resolving auth chain from %s for room %s: %v", server, r.ID, err)
+			continue
+		}
+
+		// Drop anything we already hold, then merge the rest in as older history, same as a
+		// local backward pagination response.
+		var unknown []gomatrix.Event
+		for _, event := range newEvents {
+			if _, known := r.eventIndex[event.ID]; known {
+				continue
+			}
+			unknown = append(unknown, event)
+		}
+
+		merged := r.appendOlderEvents(r.headerAll(unknown))
+
+		// Write federation-fetched history through to the store via the same path local
+		// backpagination uses, otherwise it re-vanishes on the next restart and the room quietly
+		// reverts to local-homeserver-only depth.
+		if r.store != nil {
+			if err := r.store.AppendBackpagination(r.ID, unknown, r.backPaginationToken); err != nil {
+				log.Printf("mxclient: failed to persist federation backfill for room %s: %v", r.ID, err)
+			}
+		}
+
+		return merged, nil
+	}
+
+	return 0, lastErr
+}
+
+// backfillFromServer performs one signed GET /_matrix/federation/v1/backfill/{roomID} request
+// against server and verifies every PDU it returns.
+func (fb *FederationBackfiller) backfillFromServer(server, roomID, earliestEventID string, limit int) ([]gomatrix.Event, error) {
+	endpoint := url.URL{
+		Scheme: "matrix-federation",
+		Host:   server,
+		Path:   fmt.Sprintf("/_matrix/federation/v1/backfill/%s", roomID),
+		RawQuery: url.Values{
+			"v":     {earliestEventID},
+			"limit": {fmt.Sprint(limit)},
+		}.Encode(),
+	}
+
+	req, err := gomatrixserverlib.NewFederationRequest("GET", server, endpoint.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Sign(fb.serverName, fb.keyID, fb.signingKey); err != nil {
+		return nil, err
+	}
+
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fb.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backfill request to %s returned %s", server, resp.Status)
+	}
+
+	var body federationBackfillResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	return fb.verifyPDUs(server, body.PDUs)
+}
+
+// verifyPDUs checks each PDU's signature with fb.verifier before trusting it, discarding any
+// that don't verify rather than failing the whole batch.
+func (fb *FederationBackfiller) verifyPDUs(server string, pdus []json.RawMessage) ([]gomatrix.Event, error) {
+	toVerify := make([]gomatrixserverlib.VerifyJSONRequest, len(pdus))
+	for i, pdu := range pdus {
+		toVerify[i] = gomatrixserverlib.VerifyJSONRequest{ServerName: gomatrixserverlib.ServerName(server), Message: pdu}
+	}
+
+	results, err := fb.verifier.VerifyJSONs(toVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []gomatrix.Event
+	for i, result := range results {
+		if result.Error != nil {
+			log.Printf("federation backfill: dropping unverifiable PDU from %s: %v", server, result.Error)
+			continue
+		}
+		var event gomatrix.Event
+		if err := json.Unmarshal(pdus[i], &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// resolveAuthChain walks the auth_events referenced by newEvents and fetches any we don't
+// already hold from server, so the merged timeline never references an auth event we can't
+// account for.
+func (fb *FederationBackfiller) resolveAuthChain(server string, r *Room, newEvents []gomatrix.Event) ([]gomatrix.Event, error) {
+	haveEvent := func(eventID string) bool {
+		_, ok := r.eventIndex[eventID]
+		if ok {
+			return true
+		}
+		for _, event := range newEvents {
+			if event.ID == eventID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Fetched auth events are appended to newEvents, so the loop also walks their own auth_events.
+	for i := 0; i < len(newEvents); i++ {
+		for _, authEventID := range newEvents[i].AuthEvents() {
+			if haveEvent(authEventID) {
+				continue
+			}
+			authEvent, err := fb.fetchEventByID(server, r.ID, authEventID)
+			if err != nil {
+				return nil, err
+			}
+			newEvents = append(newEvents, authEvent)
+		}
+	}
+
+	return newEvents, nil
+}
+
+// fetchEventByID retrieves a single PDU via GET /_matrix/federation/v1/event/{eventID}.
+func (fb *FederationBackfiller) fetchEventByID(server, roomID, eventID string) (gomatrix.Event, error) {
+	path := fmt.Sprintf("/_matrix/federation/v1/event/%s", eventID)
+
+	req, err := gomatrixserverlib.NewFederationRequest("GET", server, path)
+	if err != nil {
+		return gomatrix.Event{}, err
+	}
+	if err := req.Sign(fb.serverName, fb.keyID, fb.signingKey); err != nil {
+		return gomatrix.Event{}, err
+	}
+
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return gomatrix.Event{}, err
+	}
+
+	resp, err := fb.httpClient.Do(httpReq)
+	if err != nil {
+		return gomatrix.Event{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return gomatrix.Event{}, fmt.Errorf("event request to %s returned %s", server, resp.Status)
+	}
+
+	var body federationBackfillResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return gomatrix.Event{}, err
+	}
+	if len(body.PDUs) == 0 {
+		return gomatrix.Event{}, fmt.Errorf("event %s not found on %s", eventID, server)
+	}
+
+	events, err := fb.verifyPDUs(server, body.PDUs[:1])
+	if err != nil {
+		return gomatrix.Event{}, err
+	}
+	if len(events) == 0 {
+		return gomatrix.Event{}, fmt.Errorf("event %s from %s failed verification", eventID, server)
+	}
+	return events[0], nil
+}
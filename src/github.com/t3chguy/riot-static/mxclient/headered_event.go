@@ -0,0 +1,54 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import "github.com/matrix-org/gomatrix"
+
+// DefaultRoomVersion is used for rooms whose m.room.create event predates the room_version field
+// (all such rooms are version "1").
+const DefaultRoomVersion = "1"
+
+// HeaderedEvent carries a gomatrix.Event alongside the version of the room it belongs to, so that
+// version-sensitive logic - redaction rules, event ID computation, signature checks - can dispatch
+// on RoomVersion instead of having it threaded through separately or assumed. This is the same
+// abstraction dendrite uses to keep version metadata alongside events across API boundaries.
+type HeaderedEvent struct {
+	RoomVersion string
+	Event       gomatrix.Event
+}
+
+// Unwrap returns the plain gomatrix.Event, for consumers that don't need to know the room
+// version.
+func (h HeaderedEvent) Unwrap() gomatrix.Event {
+	return h.Event
+}
+
+// unwrapAll maps a slice of HeaderedEvent down to the plain gomatrix.Events inside them.
+func unwrapAll(headered []HeaderedEvent) []gomatrix.Event {
+	events := make([]gomatrix.Event, len(headered))
+	for i, h := range headered {
+		events[i] = h.Event
+	}
+	return events
+}
+
+// roomVersionFromCreateEvent extracts the room_version field from an m.room.create event's
+// content, defaulting to DefaultRoomVersion when absent (pre-v3 rooms didn't set it).
+func roomVersionFromCreateEvent(createEvent gomatrix.Event) string {
+	if version, ok := createEvent.Content["room_version"].(string); ok && version != "" {
+		return version
+	}
+	return DefaultRoomVersion
+}
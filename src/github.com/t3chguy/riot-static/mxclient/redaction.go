@@ -0,0 +1,87 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"strconv"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// redactionAllowedKeysV1 lists the content keys that survive redaction for event types which keep
+// some of their content, per the original (room version 1-8) Matrix redaction algorithm. Event
+// types not present here lose their content entirely.
+var redactionAllowedKeysV1 = map[string][]string{
+	"m.room.member":             {"membership"},
+	"m.room.create":             {"creator"},
+	"m.room.join_rules":         {"join_rule"},
+	"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+	"m.room.history_visibility": {"history_visibility"},
+	"m.room.aliases":            {"aliases"},
+	"m.room.canonical_alias":    {"alias"},
+}
+
+// redactionAllowedKeysV9 is redactionAllowedKeysV1 with the room version 9 redaction algorithm
+// changes: m.room.join_rules additionally retains "allow" (restricted joins need their allow
+// conditions to survive redaction) and m.room.member additionally retains
+// "join_authorised_via_users_server" (so a restricted join can still be told apart from a regular
+// one once redacted).
+var redactionAllowedKeysV9 = map[string][]string{
+	"m.room.member":             {"membership", "join_authorised_via_users_server"},
+	"m.room.create":             {"creator"},
+	"m.room.join_rules":         {"join_rule", "allow"},
+	"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+	"m.room.history_visibility": {"history_visibility"},
+	"m.room.aliases":            {"aliases"},
+	"m.room.canonical_alias":    {"alias"},
+}
+
+// redactionAllowedKeysForVersion returns the allowed-keys table to use for an event belonging to
+// roomVersion, dispatching on the room versions the redaction algorithm actually differs between.
+// A version we can't parse as a number (a future/experimental version string) falls back to the
+// original table, the safer of the two to default to since it drops more rather than less.
+func redactionAllowedKeysForVersion(roomVersion string) map[string][]string {
+	if version, err := strconv.Atoi(roomVersion); err == nil && version >= 9 {
+		return redactionAllowedKeysV9
+	}
+	return redactionAllowedKeysV1
+}
+
+// ApplyRedaction rewrites the content of the event targeted by redaction ev per the Matrix
+// redaction algorithm for that event's own room version, preserving only the keys
+// redactionAllowedKeysForVersion allows for its type, and records the redaction itself in
+// unsigned.redacted_because so clients can still show "[message redacted by ...]". Lookup of the
+// target event is O(1) via Room.eventIndex.
+func (r *Room) ApplyRedaction(ev *gomatrix.Event) {
+	position, ok := r.eventIndex[ev.Redacts]
+	if !ok {
+		return
+	}
+	target := &r.eventList[r.topologicalOrdering[position]]
+
+	allowed := redactionAllowedKeysForVersion(target.RoomVersion)[target.Event.Type]
+	redactedContent := make(map[string]interface{}, len(allowed))
+	for _, key := range allowed {
+		if value, present := target.Event.Content[key]; present {
+			redactedContent[key] = value
+		}
+	}
+	target.Event.Content = redactedContent
+
+	if target.Event.Unsigned == nil {
+		target.Event.Unsigned = make(map[string]interface{})
+	}
+	target.Event.Unsigned["redacted_because"] = ev
+}
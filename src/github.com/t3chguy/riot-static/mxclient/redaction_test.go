@@ -0,0 +1,101 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// TestApplyRedactionSameBatch exercises the case concatBackpagination/concatForwardPagination must
+// get right: a redaction arriving in the same batch as the event it targets. ApplyRedaction can
+// only resolve a target that's already in eventIndex, so the target must be appended/indexed
+// before the redaction is applied - this pins that ordering.
+func TestApplyRedactionSameBatch(t *testing.T) {
+	r := &Room{
+		roomVersion: DefaultRoomVersion,
+		eventIndex:  make(map[string]int),
+	}
+
+	target := gomatrix.Event{
+		ID:      "$target:example.com",
+		Type:    "m.room.message",
+		Content: map[string]interface{}{"body": "oops"},
+	}
+	redaction := gomatrix.Event{
+		ID:      "$redaction:example.com",
+		Type:    "m.room.redaction",
+		Redacts: target.ID,
+	}
+
+	// Same ordering concatBackpagination/concatForwardPagination now follow: index the batch's
+	// kept events first, then apply the batch's redactions.
+	r.appendNewerEvents(r.headerAll([]gomatrix.Event{target}))
+	r.ApplyRedaction(&redaction)
+
+	position, ok := r.eventIndex[target.ID]
+	if !ok {
+		t.Fatalf("target event %s missing from eventIndex", target.ID)
+	}
+
+	redacted := r.eventList[r.topologicalOrdering[position]].Event
+	if _, present := redacted.Content["body"]; present {
+		t.Errorf("redacted event still has body: %v", redacted.Content)
+	}
+	if redacted.Unsigned["redacted_because"] != &redaction {
+		t.Errorf("redacted event missing unsigned.redacted_because, got %v", redacted.Unsigned)
+	}
+}
+
+// TestApplyRedactionKeepsAllowedKeysByVersion checks that redaction dispatches on the target
+// event's own room version rather than applying one global table: m.room.join_rules' "allow" key
+// only survives redaction from room version 9 onwards.
+func TestApplyRedactionKeepsAllowedKeysByVersion(t *testing.T) {
+	joinRules := gomatrix.Event{
+		ID:   "$join_rules:example.com",
+		Type: "m.room.join_rules",
+		Content: map[string]interface{}{
+			"join_rule": "restricted",
+			"allow":     []interface{}{"some-condition"},
+		},
+	}
+	redaction := gomatrix.Event{ID: "$redaction:example.com", Type: "m.room.redaction", Redacts: joinRules.ID}
+
+	t.Run("v1 drops allow", func(t *testing.T) {
+		r := &Room{roomVersion: "1", eventIndex: make(map[string]int)}
+		r.appendNewerEvents(r.headerAll([]gomatrix.Event{joinRules}))
+		r.ApplyRedaction(&redaction)
+
+		content := r.eventList[0].Event.Content
+		if _, present := content["allow"]; present {
+			t.Errorf("v1 redaction should drop 'allow', got %v", content)
+		}
+		if content["join_rule"] != "restricted" {
+			t.Errorf("v1 redaction should keep 'join_rule', got %v", content)
+		}
+	})
+
+	t.Run("v9 keeps allow", func(t *testing.T) {
+		r := &Room{roomVersion: "9", eventIndex: make(map[string]int)}
+		r.appendNewerEvents(r.headerAll([]gomatrix.Event{joinRules}))
+		r.ApplyRedaction(&redaction)
+
+		content := r.eventList[0].Event.Content
+		if _, present := content["allow"]; !present {
+			t.Errorf("v9 redaction should keep 'allow', got %v", content)
+		}
+	})
+}
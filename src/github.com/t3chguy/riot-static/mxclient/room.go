@@ -16,6 +16,8 @@ package mxclient
 
 import (
 	"errors"
+	"log"
+
 	"github.com/matrix-org/gomatrix"
 	"github.com/t3chguy/riot-static/utils"
 )
@@ -39,53 +41,169 @@ type Room struct {
 	backPaginationToken    string
 	forwardPaginationToken string
 
-	eventList []gomatrix.Event
-	//eventMap        map[string]*gomatrix.Event
+	// roomVersion is read off the m.room.create event during NewRoom and stamped onto every
+	// HeaderedEvent this room stores, so version-sensitive logic (redaction, auth-event
+	// resolution, federation) always knows which rules apply without having to look it up.
+	roomVersion string
+
+	// eventList holds every event we know about in the order it was inserted, which is NOT
+	// necessarily topological order: forward pagination appends newer events to the tail,
+	// backward pagination also appends (older events don't get prepended here), so eventList
+	// itself never needs an O(n) copy. Use topologicalOrdering to read events back out in
+	// timeline order.
+	eventList []HeaderedEvent
+
+	// eventIndex gives O(1) lookup from event ID to a position in topologicalOrdering.
+	eventIndex map[string]int
+
+	// topologicalOrdering maps a position (0 = oldest event we hold, increasing = newer) to an
+	// index into eventList, similar to dendrite's topology tokens. Forward pagination appends
+	// to its tail (cheap, the hot path for a busy room); backward pagination prepends to its
+	// front (an O(n) int copy, but that's a user-paced scrollback action, not a sync hot path).
+	topologicalOrdering []int
+
 	latestRoomState RoomState
 
+	// initialState is the state snapshot as of the oldest event covered by eventList - the
+	// /initialSync response's resp.State, or the state a store hydration loaded - captured once in
+	// NewRoom and never advanced afterwards. latestRoomState keeps moving forward as the room
+	// syncs, so it reflects "state right now", not "state as of the start of the window we hold";
+	// reconstructing state at some anchor in the past needs this fixed starting point instead.
+	initialState []gomatrix.Event
+
 	hasInitialSynced bool
+
+	// store is the pluggable persistence backend for this room's timeline, state and
+	// pagination tokens, inherited from the owning Client. It may be nil, in which case the
+	// room behaves exactly as before: purely in-memory.
+	store RoomStore
 }
 
 func (r *Room) ForwardPaginateRoom() {
 	r.client.forwardpaginateRoom(r, 0)
 }
 
+// appendOlderEvents adds events - supplied newest-of-batch-first, matching a backwards /messages
+// chunk - to the room. eventList only ever grows by appending, so this never touches previously
+// stored events; only topologicalOrdering (and the eventIndex positions it invalidates) has to
+// shift, which is an O(n) int-slice operation rather than an O(n) copy of full gomatrix.Events.
+// This path is only hit by user-paced scrollback, never by the sync hot path.
+func (r *Room) appendOlderEvents(events []HeaderedEvent) int {
+	if len(events) == 0 {
+		return 0
+	}
+
+	indices := make([]int, len(events))
+	for i, event := range events {
+		indices[len(events)-1-i] = len(r.eventList)
+		r.eventList = append(r.eventList, event)
+	}
+
+	r.topologicalOrdering = append(indices, r.topologicalOrdering...)
+	for position, eventListIndex := range r.topologicalOrdering {
+		r.eventIndex[r.eventList[eventListIndex].Event.ID] = position
+	}
+
+	return len(events)
+}
+
+// appendNewerEvents adds events - supplied oldest-of-batch-first, matching a sync or forward
+// /messages response - to the tail of both eventList and topologicalOrdering. Nothing already
+// stored needs to move, so this is O(len(events)) regardless of how large the room's history is,
+// which is what actually matters for a busy room receiving a steady stream of new events.
+func (r *Room) appendNewerEvents(events []HeaderedEvent) int {
+	for _, event := range events {
+		eventListIndex := len(r.eventList)
+		r.eventList = append(r.eventList, event)
+		r.topologicalOrdering = append(r.topologicalOrdering, eventListIndex)
+		r.eventIndex[event.Event.ID] = len(r.topologicalOrdering) - 1
+	}
+	return len(events)
+}
+
+// headerAll stamps every event with r.roomVersion, the version read off this room's m.room.create
+// event during NewRoom.
+func (r *Room) headerAll(events []gomatrix.Event) []HeaderedEvent {
+	headered := make([]HeaderedEvent, len(events))
+	for i, event := range events {
+		headered[i] = HeaderedEvent{RoomVersion: r.roomVersion, Event: event}
+	}
+	return headered
+}
+
 func (r *Room) concatBackpagination(oldEvents []gomatrix.Event, newToken string) {
+	var kept []gomatrix.Event
+	var redactions []gomatrix.Event
 	for _, event := range oldEvents {
 		if event.Type == "m.room.redaction" {
-			// The server has already handled these for us
-			// so just consume them to prevent them blanking on timeline
+			redactions = append(redactions, event)
 			continue
 		}
 
-		r.eventList = append(r.eventList, event)
+		kept = append(kept, event)
+	}
+
+	// Append (and index) the batch's own events before applying its redactions: a redaction and
+	// its target routinely land in the same batch, and ApplyRedaction can only resolve a target
+	// that's already in eventIndex.
+	appendedFrom := len(r.eventList)
+	r.appendOlderEvents(r.headerAll(kept))
+	for _, redaction := range redactions {
+		r.ApplyRedaction(&redaction)
 	}
 	r.backPaginationToken = newToken
+
+	if r.store != nil {
+		// Persist the events as they now stand in eventList - with any redactions from this
+		// batch already applied - rather than the raw batch, so a redacted event doesn't come
+		// back unredacted (and redaction events themselves don't come back as literal timeline
+		// events) on the next store hydration.
+		persisted := unwrapAll(r.eventList[appendedFrom:])
+		if err := r.store.AppendBackpagination(r.ID, persisted, newToken); err != nil {
+			log.Printf("mxclient: failed to persist backpagination for room %s: %v", r.ID, err)
+		}
+	}
 }
 
 func (r *Room) concatForwardPagination(newEvents []gomatrix.Event, newToken string) {
+	var kept []gomatrix.Event
+	var redactions []gomatrix.Event
 	for _, event := range newEvents {
 		if event.Type == "m.room.redaction" {
-			// TODO Handle redaction and skip adding to TL
-			// Might want an Event Map->*Event so we can skip an O(n) task
+			redactions = append(redactions, event)
 			continue
 		}
 
 		r.latestRoomState.UpdateOnEvent(&event, false)
-		r.eventList = append([]gomatrix.Event{event}, r.eventList...)
+		kept = append(kept, event)
+	}
+
+	// Same ordering fix as concatBackpagination: index the batch's own events first so a
+	// same-batch redaction can actually find its target.
+	appendedFrom := len(r.eventList)
+	r.appendNewerEvents(r.headerAll(kept))
+	for _, redaction := range redactions {
+		r.ApplyRedaction(&redaction)
 	}
 	r.forwardPaginationToken = newToken
+
+	if r.store != nil {
+		persisted := unwrapAll(r.eventList[appendedFrom:])
+		if err := r.store.AppendForwardPagination(r.ID, persisted, newToken); err != nil {
+			log.Printf("mxclient: failed to persist forward pagination for room %s: %v", r.ID, err)
+		}
+	}
 }
 
 func (r *Room) GetTokens() (string, string) {
 	return r.backPaginationToken, r.forwardPaginationToken
 }
 
+// findEventIndex resolves anchor to its position in topologicalOrdering in O(1) via eventIndex,
+// backpaginating once and retrying if it isn't present yet and the caller allows it.
 func (r *Room) findEventIndex(anchor string, backpaginate bool) (int, bool) {
-	for index, event := range r.eventList {
-		if event.ID == anchor {
-			return index, true
-		}
+	if position, ok := r.eventIndex[anchor]; ok {
+		return position, true
 	}
 
 	if backpaginate {
@@ -100,28 +218,63 @@ func (r *Room) findEventIndex(anchor string, backpaginate bool) (int, bool) {
 // backpaginate on every single call.
 const overcompensateBackpaginationBy = 32
 
-func (r *Room) getBackwardEventRange(anchorIndex, offset, number int) []gomatrix.Event {
-	length := len(r.eventList)
+// eventsInRange returns the events at positions [startPos, endPos) in topologicalOrdering,
+// oldest to newest.
+func (r *Room) eventsInRange(startPos, endPos int) []gomatrix.Event {
+	if startPos >= endPos {
+		return []gomatrix.Event{}
+	}
+
+	events := make([]gomatrix.Event, 0, endPos-startPos)
+	for _, eventListIndex := range r.topologicalOrdering[startPos:endPos] {
+		events = append(events, r.eventList[eventListIndex].Event)
+	}
+	return events
+}
 
-	// delta is the number of events we should have, to comfortably handle this request, if we do not have this many
-	// then ask the mxclient to backpaginate this room by at least delta-length events.
-	// TODO if numNew = 0, we are at end of TL as we know it, mark this room as such.
-	if delta := anchorIndex + offset + number + overcompensateBackpaginationBy; delta >= length {
-		// if no error encountered then we have new events, update our previously calculated length by the len of these.
-		if numNew, err := r.client.backpaginateRoom(r, delta-length); err == nil {
+// getBackwardEventRange returns number events at or before position anchorPos-offset (i.e.
+// further back in the room's history), backpaginating - and falling back to federation - first
+// if we don't hold enough older history locally.
+func (r *Room) getBackwardEventRange(anchorPos, offset, number int) []gomatrix.Event {
+	length := len(r.topologicalOrdering)
+	targetPos := anchorPos - offset
+
+	// deficit is how many more older events we'd need fetched for the window to stay within
+	// bounds, plus a buffer so we don't refetch on every single call.
+	// TODO if numNew = 0, we are at the start of the TL as we know it, mark this room as such.
+	if deficit := number - targetPos - 1 + overcompensateBackpaginationBy; deficit > 0 {
+		numNew, err := r.client.backpaginateRoom(r, deficit)
+		if err == nil {
+			targetPos += numNew
 			length += numNew
 		}
+
+		// The local homeserver came up short: if we know of other servers in this room,
+		// fall back to asking them directly for the rest of the history we wanted, the same
+		// way the roomserver backfills from federation when local storage runs dry.
+		if numNew < deficit && r.client.Federation != nil && len(r.latestRoomState.Servers()) > 0 {
+			if federatedNew, ferr := r.client.Federation.Backfill(r, deficit-numNew); ferr == nil {
+				targetPos += federatedNew
+				length += federatedNew
+			} else {
+				log.Printf("mxclient: federation backfill failed for room %s: %v", r.ID, ferr)
+			}
+		}
 	}
 
-	startIndex := utils.Min(anchorIndex+offset, length)
-	return r.eventList[startIndex:utils.Min(startIndex+number, length)]
+	endPos := utils.Bound(0, targetPos+1, length)
+	startPos := utils.Max(endPos-number, 0)
+	return r.eventsInRange(startPos, endPos)
 }
 
-func (r *Room) getForwardEventRange(index, offset, number int) []gomatrix.Event {
-	length := len(r.eventList)
-	topIndex := utils.Bound(0, index+number-offset, length)
+// getForwardEventRange returns number events starting at position anchorPos+offset and moving
+// toward the live tail of the timeline.
+func (r *Room) getForwardEventRange(anchorPos, offset, number int) []gomatrix.Event {
+	length := len(r.topologicalOrdering)
+	startPos := utils.Bound(0, anchorPos+offset, length)
+	endPos := utils.Bound(0, startPos+number, length)
 
-	return r.eventList[utils.Max(topIndex-number, 0):topIndex]
+	return r.eventsInRange(startPos, endPos)
 }
 
 func (r *Room) GetState() RoomState {
@@ -150,35 +303,107 @@ func (r *Room) GetEventPage(anchor string, offset int, pageSize int) (events []g
 const RoomInitialSyncLimit = 256
 
 func (m *Client) NewRoom(roomID string) (*Room, error) {
+	// Storage first: only fall back to the homeserver's /initialSync when the local store has
+	// never seen this room, the same order the roomserver backfill model asks for history in.
+	if m.Store != nil {
+		if events, state, backToken, forwardToken, roomVersion, ok, err := m.Store.LoadRoom(roomID); err != nil {
+			log.Printf("mxclient: failed to load room %s from store: %v", roomID, err)
+		} else if ok {
+			newRoom := &Room{
+				client:                 m,
+				ID:                     roomID,
+				roomVersion:            roomVersion,
+				forwardPaginationToken: forwardToken,
+				backPaginationToken:    backToken,
+				eventIndex:             make(map[string]int, len(events)),
+				topologicalOrdering:    make([]int, len(events)),
+				latestRoomState:        *NewRoomState(m),
+				initialState:           state,
+				hasInitialSynced:       true,
+				store:                  m.Store,
+			}
+			newRoom.eventList = newRoom.headerAll(events)
+
+			// events is already persisted oldest-to-newest, so eventList's insertion order
+			// doubles as topological order here.
+			for i := range newRoom.eventList {
+				newRoom.topologicalOrdering[i] = i
+				newRoom.eventIndex[newRoom.eventList[i].Event.ID] = i
+			}
+
+			for _, event := range state {
+				newRoom.latestRoomState.UpdateOnEvent(&event, true)
+			}
+
+			return newRoom, nil
+		}
+	}
+
 	resp, err := m.RoomInitialSync(roomID, RoomInitialSyncLimit)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// filter out m.room.redactions and reverse ordering at once.
+	// drop m.room.redactions from the timeline proper (they're applied below once the room
+	// exists) and reverse ordering at once, since /initialSync returns newest-first.
 	var filteredEventList []gomatrix.Event
+	var redactions []gomatrix.Event
 	for _, event := range resp.Messages.Chunk {
-		if event.Type != "m.room.redaction" {
+		if event.Type == "m.room.redaction" {
+			redactions = append(redactions, event)
 			continue
 		}
 
 		filteredEventList = append([]gomatrix.Event{event}, filteredEventList...)
 	}
 
+	roomVersion := DefaultRoomVersion
+	for _, event := range resp.State {
+		if event.Type == "m.room.create" {
+			roomVersion = roomVersionFromCreateEvent(event)
+			break
+		}
+	}
+
 	newRoom := &Room{
-		client: m,
-		ID:     roomID,
+		client:                 m,
+		ID:                     roomID,
+		roomVersion:            roomVersion,
 		forwardPaginationToken: resp.Messages.End,
 		backPaginationToken:    resp.Messages.Start,
-		eventList:              filteredEventList,
+		eventIndex:             make(map[string]int, len(filteredEventList)),
+		topologicalOrdering:    make([]int, len(filteredEventList)),
 		latestRoomState:        *NewRoomState(m),
+		initialState:           resp.State,
+		store:                  m.Store,
+	}
+	newRoom.eventList = newRoom.headerAll(filteredEventList)
+
+	// filteredEventList was built oldest-first above, so eventList's insertion order doubles
+	// as topological order here too.
+	for i := range newRoom.eventList {
+		newRoom.topologicalOrdering[i] = i
+		newRoom.eventIndex[newRoom.eventList[i].Event.ID] = i
+	}
+
+	for _, redaction := range redactions {
+		newRoom.ApplyRedaction(&redaction)
 	}
 
 	for _, event := range resp.State {
 		newRoom.latestRoomState.UpdateOnEvent(&event, true)
 	}
 
+	if m.Store != nil {
+		// Persist eventList as it stands now - with the redactions above already applied -
+		// rather than filteredEventList, which still holds their pre-redaction content.
+		persisted := unwrapAll(newRoom.eventList)
+		if err := m.Store.SaveInitialSync(roomID, persisted, resp.State, newRoom.backPaginationToken, newRoom.forwardPaginationToken, roomVersion); err != nil {
+			log.Printf("mxclient: failed to persist initial sync for room %s: %v", roomID, err)
+		}
+	}
+
 	return newRoom, nil
 }
 
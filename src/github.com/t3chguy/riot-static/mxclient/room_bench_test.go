@@ -0,0 +1,64 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// roomWithNEvents builds a Room already holding n events, to benchmark against a long-lived,
+// busy room rather than one starting from empty.
+func roomWithNEvents(n int) *Room {
+	r := &Room{
+		ID:          "!bench:example.com",
+		roomVersion: DefaultRoomVersion,
+		eventIndex:  make(map[string]int, n),
+	}
+	events := make([]gomatrix.Event, n)
+	for i := range events {
+		events[i] = gomatrix.Event{ID: fmt.Sprintf("$%d:example.com", i), Type: "m.room.message"}
+	}
+	r.appendNewerEvents(r.headerAll(events))
+	return r
+}
+
+// BenchmarkAppendNewerEvents100kRoom simulates a sync receiving one new event at a time in a
+// room that already has 100k events behind it - the "busy room after long uptime" case the old
+// append([]Event{ev}, r.eventList...) prepend was catastrophic for.
+func BenchmarkAppendNewerEvents100kRoom(b *testing.B) {
+	r := roomWithNEvents(100000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.appendNewerEvents(r.headerAll([]gomatrix.Event{{ID: fmt.Sprintf("$new%d:example.com", i), Type: "m.room.message"}}))
+	}
+}
+
+// BenchmarkFindEventIndex100kRoom exercises the O(1) eventIndex lookup that replaced the O(n)
+// linear scan over eventList.
+func BenchmarkFindEventIndex100kRoom(b *testing.B) {
+	r := roomWithNEvents(100000)
+	anchor := "$50000:example.com"
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, found := r.findEventIndex(anchor, false); !found {
+			b.Fatal("expected to find anchor event")
+		}
+	}
+}
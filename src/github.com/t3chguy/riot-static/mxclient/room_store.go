@@ -0,0 +1,313 @@
+// Copyright 2017 Michael Telatynski <7t3chguy@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mxclient
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrix"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// RoomStore is the persistence boundary for a Room's timeline. Implementations are expected to
+// key events by (room_id, topological_index) so that backward and forward pagination can each
+// append without disturbing the other's ordering. A Room asks its RoomStore for a range before
+// ever falling back to the homeserver, the same "storage first" model the roomserver backfill
+// code follows.
+type RoomStore interface {
+	// LoadRoom returns everything persisted for roomID: its events in topological order, the
+	// state events saved by SaveInitialSync (the Append methods do not update them), the
+	// back/forward pagination tokens and the room's version. ok
+	// is false if the store has never seen this room, in which case the caller should fall back
+	// to RoomInitialSync.
+	LoadRoom(roomID string) (events []gomatrix.Event, state []gomatrix.Event, backToken, forwardToken, roomVersion string, ok bool, err error)
+
+	// SaveInitialSync persists the result of a fresh RoomInitialSync.
+	SaveInitialSync(roomID string, events []gomatrix.Event, state []gomatrix.Event, backToken, forwardToken, roomVersion string) error
+
+	// AppendBackpagination persists newly backpaginated events (oldest timeline direction) and
+	// advances the stored back-pagination token.
+	AppendBackpagination(roomID string, events []gomatrix.Event, newBackToken string) error
+
+	// AppendForwardPagination persists newly synced/forward-paginated events and advances the
+	// stored forward-pagination token.
+	AppendForwardPagination(roomID string, events []gomatrix.Event, newForwardToken string) error
+
+	// Close releases any underlying resources (e.g. the database handle).
+	Close() error
+}
+
+// SQLiteRoomStore is the default RoomStore, backing a single SQLite database shared by every
+// room the process has joined.
+type SQLiteRoomStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteRoomStore opens (creating if necessary) a SQLite-backed RoomStore at path.
+func NewSQLiteRoomStore(path string) (*SQLiteRoomStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS room_events (
+			room_id            TEXT NOT NULL,
+			topological_index  INTEGER NOT NULL,
+			event_id           TEXT NOT NULL,
+			event_json         TEXT NOT NULL,
+			PRIMARY KEY (room_id, topological_index)
+		);
+		CREATE INDEX IF NOT EXISTS room_events_event_id ON room_events (room_id, event_id);
+
+		CREATE TABLE IF NOT EXISTS room_state (
+			room_id    TEXT NOT NULL,
+			type       TEXT NOT NULL,
+			state_key  TEXT NOT NULL,
+			event_json TEXT NOT NULL,
+			PRIMARY KEY (room_id, type, state_key)
+		);
+
+		CREATE TABLE IF NOT EXISTS room_meta (
+			room_id       TEXT PRIMARY KEY,
+			back_token    TEXT NOT NULL,
+			forward_token TEXT NOT NULL,
+			min_index     INTEGER NOT NULL,
+			next_index    INTEGER NOT NULL,
+			room_version  TEXT NOT NULL DEFAULT '1'
+		);
+	`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteRoomStore{db: db}, nil
+}
+
+func (s *SQLiteRoomStore) LoadRoom(roomID string) (events []gomatrix.Event, state []gomatrix.Event, backToken, forwardToken, roomVersion string, ok bool, err error) {
+	row := s.db.QueryRow(`SELECT back_token, forward_token, room_version FROM room_meta WHERE room_id = ?`, roomID)
+	if err = row.Scan(&backToken, &forwardToken, &roomVersion); err == sql.ErrNoRows {
+		return nil, nil, "", "", "", false, nil
+	} else if err != nil {
+		return nil, nil, "", "", "", false, err
+	}
+
+	rows, err := s.db.Query(`SELECT event_json FROM room_events WHERE room_id = ? ORDER BY topological_index ASC`, roomID)
+	if err != nil {
+		return nil, nil, "", "", "", false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw string
+		if err = rows.Scan(&raw); err != nil {
+			return nil, nil, "", "", "", false, err
+		}
+		var event gomatrix.Event
+		if err = json.Unmarshal([]byte(raw), &event); err != nil {
+			return nil, nil, "", "", "", false, err
+		}
+		events = append(events, event)
+	}
+
+	stateRows, err := s.db.Query(`SELECT event_json FROM room_state WHERE room_id = ?`, roomID)
+	if err != nil {
+		return nil, nil, "", "", "", false, err
+	}
+	defer stateRows.Close()
+
+	for stateRows.Next() {
+		var raw string
+		if err = stateRows.Scan(&raw); err != nil {
+			return nil, nil, "", "", "", false, err
+		}
+		var event gomatrix.Event
+		if err = json.Unmarshal([]byte(raw), &event); err != nil {
+			return nil, nil, "", "", "", false, err
+		}
+		state = append(state, event)
+	}
+
+	return events, state, backToken, forwardToken, roomVersion, true, nil
+}
+
+func (s *SQLiteRoomStore) SaveInitialSync(roomID string, events []gomatrix.Event, state []gomatrix.Event, backToken, forwardToken, roomVersion string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM room_events WHERE room_id = ?`, roomID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM room_state WHERE room_id = ?`, roomID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	nextIndex, err := appendEvents(tx, roomID, 0, events)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := saveState(tx, roomID, state); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT OR REPLACE INTO room_meta (room_id, back_token, forward_token, min_index, next_index, room_version) VALUES (?, ?, ?, ?, ?, ?)`,
+		roomID, backToken, forwardToken, 0, nextIndex, roomVersion,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AppendBackpagination persists events older than anything held for roomID. Since room_events is
+// ordered by topological_index ascending, older events need indices below the room's current
+// minimum, so this walks min_index downward rather than advancing next_index.
+func (s *SQLiteRoomStore) AppendBackpagination(roomID string, events []gomatrix.Event, newBackToken string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var minIndex int
+	row := tx.QueryRow(`SELECT min_index FROM room_meta WHERE room_id = ?`, roomID)
+	if err := row.Scan(&minIndex); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+
+	// events arrive newest-of-batch first (the order a backwards /messages chunk is returned
+	// in); assign them indices counting down from minIndex-1 so that, once sorted ascending,
+	// they still read oldest-to-newest.
+	newMinIndex := minIndex
+	for _, event := range events {
+		newMinIndex--
+		raw, err := json.Marshal(event)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT OR REPLACE INTO room_events (room_id, topological_index, event_id, event_json) VALUES (?, ?, ?, ?)`,
+			roomID, newMinIndex, event.ID, string(raw),
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE room_meta SET back_token = ?, min_index = ? WHERE room_id = ?`,
+		newBackToken, newMinIndex, roomID,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AppendForwardPagination persists events newer than anything held for roomID, advancing
+// next_index so they sort after everything already stored.
+func (s *SQLiteRoomStore) AppendForwardPagination(roomID string, events []gomatrix.Event, newForwardToken string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var nextIndex int
+	row := tx.QueryRow(`SELECT next_index FROM room_meta WHERE room_id = ?`, roomID)
+	if err := row.Scan(&nextIndex); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+
+	newNextIndex, err := appendEvents(tx, roomID, nextIndex, events)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE room_meta SET forward_token = ?, next_index = ? WHERE room_id = ?`,
+		newForwardToken, newNextIndex, roomID,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRoomStore) Close() error {
+	return s.db.Close()
+}
+
+// appendEvents writes events to room_events starting at startIndex, returning the next free
+// topological_index.
+func appendEvents(tx *sql.Tx, roomID string, startIndex int, events []gomatrix.Event) (int, error) {
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO room_events (room_id, topological_index, event_id, event_json) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return startIndex, err
+	}
+	defer stmt.Close()
+
+	index := startIndex
+	for _, event := range events {
+		raw, err := json.Marshal(event)
+		if err != nil {
+			return index, err
+		}
+		if _, err := stmt.Exec(roomID, index, event.ID, string(raw)); err != nil {
+			return index, err
+		}
+		index++
+	}
+
+	return index, nil
+}
+
+func saveState(tx *sql.Tx, roomID string, state []gomatrix.Event) error {
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO room_state (room_id, type, state_key, event_json) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range state {
+		raw, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		var stateKey string
+		if event.StateKey != nil {
+			stateKey = *event.StateKey
+		}
+		if _, err := stmt.Exec(roomID, event.Type, stateKey, string(raw)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}